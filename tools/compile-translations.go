@@ -32,15 +32,20 @@
 //     std::size_t locale_table_size = /* ... */;
 //
 // The lookup table is compile-time-only. It is used to convert an untranslated
-// string into an index into the mapping table. The lookup table is a sorted
-// list of the untranslated strings. The sorting makes output deterministic and
-// also enables binary searching.
+// string into an index into the mapping table. Rather than scanning every
+// untranslated string (which made consteval lookup slower the more messages
+// quick-lint-js knew about), the lookup table is a CHD-style minimum perfect
+// hash: a small displacement table (indexed by a first hash of the key)
+// selects the offset_basis of a second hash that, for every key, lands on a
+// distinct slot of a table exactly as big as the key set. Looking up a key is
+// therefore two hashes and one equality check, regardless of how many
+// messages exist.
 //
 // The mapping table and the locale table are run-time-only. They look like this
 // (C++ code):
 //
 //     struct mapping_entry {
-//       std::uint32_t string_offsets[locale_count + 1];
+//       std::uint32_t string_offsets[plural_slot_count];
 //     };
 //     mapping_entry mapping_table[mapping_table_size];
 //
@@ -50,17 +55,33 @@
 //       /* ... */
 //       "";  // C++ adds an extra null byte for us.
 //
-// mapping_entry::string_offsets[i] corresponds to the i-th locale listed in
-// locale_table.
+// Each locale (plus one extra, untranslated, "locale" at the end, matching
+// locale_table's terminating "") owns a run of plural_slot_start[i] ..
+// plural_slot_start[i]+plural_count[i] consecutive slots in string_offsets,
+// one slot per msgstr[] form that locale's Plural-Forms header declares. A
+// message with no msgid_plural repeats its only string across every one of
+// its slots, so looking a message up never needs to special-case it.
+// plural_form_index(locale_index, n) (also generated) picks which of a
+// locale's slots applies to a given count.
 //
-// mapping_entry::string_offsets[locale_count] refers to the original
-// (untranslated) string.
+// mapping_entry::string_offsets[plural_slot_start[locale_count]] refers to
+// the original (untranslated) string; that last "locale" always has 2 slots
+// (singular, plural), using English's own pluralization rule.
 //
 // Entry 0 of the mapping table is unused.
 //
 // The string table contains 0-terminated UTF-8 strings. String sizes can be
 // computed by calculating the difference between the first 0 byte starting at
 // the string offset and the string offset.
+//
+// Not every runtime-requested locale (e.g. whatever LC_ALL says) exactly
+// matches one we compiled in, so locale_fallback_table[locale_count][4]
+// precomputes, for each compiled locale, the chain of locale indexes
+// resolve_locale (C++) tries before giving up: the locale itself, then with
+// its codeset stripped, then with its @modifier stripped, then with its
+// _REGION stripped too (e.g. "pt_BR" falls back to "pt" if only pt.po was
+// compiled). A step with nothing left to strip repeats the previous step's
+// index.
 
 package main
 
@@ -68,19 +89,31 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/binary"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"unicode/utf8"
 )
 
 const poDirectory string = "po"
 
+// useGettextTools makes the generator shell out to msgfmt/msgen (via
+// POFileToGMO/POTFileToGMO/ExtractGMOStrings) instead of using the built-in
+// PO parser. It exists to verify the built-in parser against GNU gettext;
+// the built-in parser is what every normal build uses.
+var useGettextTools = flag.Bool("use-gettext-tools", false, "parse .po files using msgfmt/msgen instead of the built-in parser (for verifying the built-in parser)")
+
 func main() {
+	flag.Parse()
+
 	poFiles, err := ListPOFiles()
 	if err != nil {
 		log.Fatal(err)
@@ -88,20 +121,23 @@ func main() {
 
 	locales := map[string][]TranslationEntry{}
 	for _, poFilePath := range poFiles {
-		gmo, err := POFileToGMO(poFilePath)
+		entries, err := ReadPOFile(poFilePath)
 		if err != nil {
 			log.Fatal(err)
 		}
-		locales[POPathToLocaleName(poFilePath)] = ExtractGMOStrings(gmo)
+		locales[POPathToLocaleName(poFilePath)] = entries
 	}
 
-	sourceGMO, err := POTFileToGMO(filepath.Join(poDirectory, "messages.pot"))
+	sourceEntries, err := ReadPOTFile(filepath.Join(poDirectory, "messages.pot"))
 	if err != nil {
 		log.Fatal(err)
 	}
-	locales[""] = ExtractGMOStrings(sourceGMO)
+	locales[""] = sourceEntries
 
-	table := CreateTranslationTable(locales)
+	table, err := CreateTranslationTable(locales)
+	if err != nil {
+		log.Fatal(err)
+	}
 	if err := WriteTranslationTableHeader(&table, "src/quick-lint-js/translation-table-generated.h"); err != nil {
 		log.Fatal(err)
 	}
@@ -188,15 +224,317 @@ func POTFileToGMO(potFilePath string) ([]byte, error) {
 	return gmo.Bytes(), nil
 }
 
+// ReadPOFile reads the translations in a .po file for a single locale.
+//
+// By default this uses the built-in PO parser (ParsePOFile). Pass
+// -use-gettext-tools to instead shell out to msgfmt, for comparison.
+func ReadPOFile(poFilePath string) ([]TranslationEntry, error) {
+	if *useGettextTools {
+		gmo, err := POFileToGMO(poFilePath)
+		if err != nil {
+			return nil, err
+		}
+		return ExtractGMOStrings(gmo), nil
+	}
+	return ParsePOFile(poFilePath)
+}
+
+// ReadPOTFile reads the untranslated messages in messages.pot, using each
+// message's msgid as its own "translation".
+//
+// By default this uses the built-in PO parser (ParsePOFile). Pass
+// -use-gettext-tools to instead shell out to msgen and msgfmt, for
+// comparison.
+func ReadPOTFile(potFilePath string) ([]TranslationEntry, error) {
+	if *useGettextTools {
+		gmo, err := POTFileToGMO(potFilePath)
+		if err != nil {
+			return nil, err
+		}
+		return ExtractGMOStrings(gmo), nil
+	}
+	entries, err := ParsePOFile(potFilePath)
+	if err != nil {
+		return nil, err
+	}
+	for i := range entries {
+		if entries[i].HasPlural() {
+			entries[i].Translated = [][]byte{entries[i].Untranslated, entries[i].UntranslatedPlural}
+		} else {
+			entries[i].Translated = [][]byte{entries[i].Untranslated}
+		}
+	}
+	return entries, nil
+}
+
+// poMessage is a single msgid/msgstr block parsed out of a .po or .pot file,
+// before it is flattened into one or more TranslationEntry values.
+type poMessage struct {
+	Context  []byte   // msgctxt. nil if absent.
+	ID       []byte   // msgid.
+	IDPlural []byte   // msgid_plural. nil if absent.
+	Strings  [][]byte // msgstr, or msgstr[0], msgstr[1], ... for plurals.
+	Fuzzy    bool     // true if tagged "#, fuzzy".
+}
+
+func (message *poMessage) IsMetadata() bool {
+	return len(message.ID) == 0
+}
+
+// ParsePOFile parses a GNU gettext .po (or .pot) file without shelling out to
+// msgfmt/msgen.
+func ParsePOFile(poFilePath string) ([]TranslationEntry, error) {
+	data, err := ioutil.ReadFile(poFilePath)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := ParsePOData(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", poFilePath, err)
+	}
+	entries := make([]TranslationEntry, 0, len(messages))
+	for _, message := range messages {
+		if message.Fuzzy && !message.IsMetadata() {
+			// Gettext's msgfmt excludes fuzzy (not-yet-reviewed) translations
+			// from the compiled catalog.
+			continue
+		}
+		translated := message.Strings
+		if len(translated) == 0 {
+			translated = [][]byte{nil}
+		}
+		entries = append(entries, TranslationEntry{
+			Untranslated:       message.ID,
+			Context:            message.Context,
+			UntranslatedPlural: message.IDPlural,
+			Translated:         translated,
+		})
+	}
+	return entries, nil
+}
+
+// ParsePOData parses the contents of a .po (or .pot) file into a sequence of
+// messages, one per msgid/msgstr block.
+func ParsePOData(data []byte) ([]poMessage, error) {
+	var messages []poMessage
+	var current poMessage
+	sawContent := false
+
+	// Set while accumulating continuation string literals ("..." lines) onto
+	// the most recently seen msgid/msgid_plural/msgctxt/msgstr[N] keyword.
+	var activeField *[]byte
+	activeStringIndex := -1
+
+	appendLiteral := func(literal []byte) {
+		if activeStringIndex >= 0 {
+			current.Strings[activeStringIndex] = append(current.Strings[activeStringIndex], literal...)
+		} else if activeField != nil {
+			*activeField = append(*activeField, literal...)
+		}
+	}
+	setStringAt := func(index int, literal []byte) {
+		for len(current.Strings) <= index {
+			current.Strings = append(current.Strings, nil)
+		}
+		current.Strings[index] = literal
+		activeField = nil
+		activeStringIndex = index
+	}
+	flush := func() {
+		if sawContent {
+			messages = append(messages, current)
+		}
+		current = poMessage{}
+		sawContent = false
+		activeField = nil
+		activeStringIndex = -1
+	}
+
+	for lineNumber, rawLine := range bytes.Split(data, []byte("\n")) {
+		line := bytes.TrimSpace(rawLine)
+		if len(line) == 0 {
+			flush()
+			continue
+		}
+		if line[0] == '#' {
+			if bytes.HasPrefix(line, []byte("#,")) {
+				for _, poFlag := range bytes.Split(line[len("#,"):], []byte(",")) {
+					if string(bytes.TrimSpace(poFlag)) == "fuzzy" {
+						current.Fuzzy = true
+					}
+				}
+			}
+			continue
+		}
+		if line[0] == '"' {
+			literal, err := parsePOStringLiteral(line)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNumber+1, err)
+			}
+			appendLiteral(literal)
+			continue
+		}
+
+		sawContent = true
+		keyword, rest := splitPOKeywordLine(line)
+		literal, err := parsePOStringLiteral(rest)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber+1, err)
+		}
+		switch {
+		case bytes.Equal(keyword, []byte("msgctxt")):
+			current.Context = literal
+			activeField = &current.Context
+			activeStringIndex = -1
+		case bytes.Equal(keyword, []byte("msgid")):
+			current.ID = literal
+			activeField = &current.ID
+			activeStringIndex = -1
+		case bytes.Equal(keyword, []byte("msgid_plural")):
+			current.IDPlural = literal
+			activeField = &current.IDPlural
+			activeStringIndex = -1
+		case bytes.Equal(keyword, []byte("msgstr")):
+			setStringAt(0, literal)
+		case bytes.HasPrefix(keyword, []byte("msgstr[")) && bytes.HasSuffix(keyword, []byte("]")):
+			indexString := string(keyword[len("msgstr[") : len(keyword)-1])
+			index, err := strconv.Atoi(indexString)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: malformed %s", lineNumber+1, keyword)
+			}
+			setStringAt(index, literal)
+		default:
+			return nil, fmt.Errorf("line %d: unrecognized PO keyword: %s", lineNumber+1, keyword)
+		}
+	}
+	flush()
+
+	return messages, nil
+}
+
+// splitPOKeywordLine splits a line like `msgid "hello"` into ("msgid",
+// `"hello"`).
+func splitPOKeywordLine(line []byte) (keyword []byte, rest []byte) {
+	space := bytes.IndexByte(line, ' ')
+	if space == -1 {
+		return line, nil
+	}
+	return line[:space], bytes.TrimSpace(line[space+1:])
+}
+
+// parsePOStringLiteral parses a single C-style quoted string, as used for a
+// msgid/msgstr and its continuation lines, handling gettext's escape
+// sequences (\n, \t, \", \\, \xNN, \uNNNN, and so on).
+func parsePOStringLiteral(literal []byte) ([]byte, error) {
+	if len(literal) < 2 || literal[0] != '"' || literal[len(literal)-1] != '"' {
+		return nil, fmt.Errorf("malformed PO string literal: %s", literal)
+	}
+	body := literal[1 : len(literal)-1]
+
+	result := make([]byte, 0, len(body))
+	for i := 0; i < len(body); i += 1 {
+		c := body[i]
+		if c != '\\' {
+			result = append(result, c)
+			continue
+		}
+		i += 1
+		if i >= len(body) {
+			return nil, fmt.Errorf("trailing backslash in PO string literal: %s", literal)
+		}
+		switch body[i] {
+		case 'n':
+			result = append(result, '\n')
+		case 't':
+			result = append(result, '\t')
+		case 'r':
+			result = append(result, '\r')
+		case 'a':
+			result = append(result, '\a')
+		case 'b':
+			result = append(result, '\b')
+		case 'f':
+			result = append(result, '\f')
+		case 'v':
+			result = append(result, '\v')
+		case '"':
+			result = append(result, '"')
+		case '\\':
+			result = append(result, '\\')
+		case 'x':
+			if i+2 >= len(body) {
+				return nil, fmt.Errorf("truncated \\x escape in PO string literal: %s", literal)
+			}
+			value, err := strconv.ParseUint(string(body[i+1:i+3]), 16, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid \\x escape in PO string literal: %s", literal)
+			}
+			result = append(result, byte(value))
+			i += 2
+		case 'u':
+			if i+4 >= len(body) {
+				return nil, fmt.Errorf("truncated \\u escape in PO string literal: %s", literal)
+			}
+			value, err := strconv.ParseUint(string(body[i+1:i+5]), 16, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid \\u escape in PO string literal: %s", literal)
+			}
+			var runeBytes [utf8.UTFMax]byte
+			n := utf8.EncodeRune(runeBytes[:], rune(value))
+			result = append(result, runeBytes[:n]...)
+			i += 4
+		default:
+			result = append(result, body[i])
+		}
+	}
+	return result, nil
+}
+
 type TranslationEntry struct {
 	Untranslated []byte
-	Translated   []byte
+	// Context is the message's msgctxt, or nil if the message has none.
+	// Messages with the same Untranslated but different Context are
+	// considered distinct messages; see ContextualKey.
+	Context []byte
+	// UntranslatedPlural is the message's msgid_plural, or nil if the message
+	// has no plural form.
+	UntranslatedPlural []byte
+	// Translated holds one string per plural form: Translated[0] is msgstr (or
+	// msgstr[0]), Translated[1] is msgstr[1], and so on. A message with no
+	// plural form has exactly one entry.
+	Translated [][]byte
 }
 
 func (entry *TranslationEntry) IsMetadata() bool {
 	return len(entry.Untranslated) == 0
 }
 
+func (entry *TranslationEntry) HasPlural() bool {
+	return len(entry.UntranslatedPlural) != 0
+}
+
+// ContextualKey returns the bytes used to look up a message: just
+// untranslated if context is empty, or "context\x04untranslated" otherwise.
+// This is the same "\x04"-joined wire format gettext itself uses to key
+// context-disambiguated messages, which is why the const-lookup hash table
+// (built over plain []byte keys) needs no special-casing for context: a
+// contextual key just hashes like any other byte string.
+func ContextualKey(context []byte, untranslated []byte) []byte {
+	if len(context) == 0 {
+		return untranslated
+	}
+	key := make([]byte, 0, len(context)+1+len(untranslated))
+	key = append(key, context...)
+	key = append(key, '\x04')
+	key = append(key, untranslated...)
+	return key
+}
+
+// ExtractGMOStrings decodes the string pairs out of a compiled .mo/.gmo file.
+// A plural message's original string is "msgid\x00msgid_plural" and its
+// translated string is "msgstr[0]\x00msgstr[1]\x00...", per the GNU gettext
+// binary format. A message with a msgctxt has its context and msgid joined
+// as "msgctxt\x04msgid" instead of a plain "msgid".
 func ExtractGMOStrings(gmoData []byte) []TranslationEntry {
 	var magic uint32 = binary.LittleEndian.Uint32(gmoData[0:])
 	var decode binary.ByteOrder
@@ -218,10 +556,21 @@ func ExtractGMOStrings(gmoData []byte) []TranslationEntry {
 	originalTableOffset := decode.Uint32(gmoData[12:])
 	translatedTableOffset := decode.Uint32(gmoData[16:])
 	for i := uint32(0); i < stringCount; i += 1 {
-		entries = append(entries, TranslationEntry{
-			Untranslated: stringAt(originalTableOffset, i),
-			Translated:   stringAt(translatedTableOffset, i),
-		})
+		rawOriginal := stringAt(originalTableOffset, i)
+		var context []byte
+		if ctxEnd := bytes.IndexByte(rawOriginal, '\x04'); ctxEnd != -1 {
+			context, rawOriginal = rawOriginal[:ctxEnd], rawOriginal[ctxEnd+1:]
+		}
+		original := bytes.SplitN(rawOriginal, []byte{0}, 2)
+		entry := TranslationEntry{
+			Context:      context,
+			Untranslated: original[0],
+			Translated:   bytes.Split(stringAt(translatedTableOffset, i), []byte{0}),
+		}
+		if len(original) > 1 {
+			entry.UntranslatedPlural = original[1]
+		}
+		entries = append(entries, entry)
 	}
 	return entries
 }
@@ -241,53 +590,533 @@ func GetLocaleNames(locales map[string][]TranslationEntry) []string {
 	return localeNames
 }
 
-// Extracts .Untranslated from each TranslationEntry.
+// StripLocaleCodeset removes a trailing ".codeset" component, e.g.
+// "pt_BR.UTF-8" becomes "pt_BR". If locale has no codeset, it is returned
+// unchanged.
+func StripLocaleCodeset(locale string) string {
+	if i := strings.IndexByte(locale, '.'); i != -1 {
+		return locale[:i]
+	}
+	return locale
+}
+
+// StripLocaleModifier removes a trailing "@modifier" component, e.g.
+// "sr_RS@latin" becomes "sr_RS". If locale has no modifier, it is returned
+// unchanged.
+func StripLocaleModifier(locale string) string {
+	if i := strings.IndexByte(locale, '@'); i != -1 {
+		return locale[:i]
+	}
+	return locale
+}
+
+// StripLocaleRegion removes a trailing "_REGION" component, e.g. "pt_BR"
+// becomes "pt". If locale has no region, it is returned unchanged.
+func StripLocaleRegion(locale string) string {
+	if i := strings.IndexByte(locale, '_'); i != -1 {
+		return locale[:i]
+	}
+	return locale
+}
+
+// NormalizeLocaleCase lowercases a locale's language component and
+// uppercases its _REGION component, e.g. "PT_br" becomes "pt_BR". Any
+// .codeset or @modifier suffix is left untouched. This mirrors how glibc
+// matches LC_ALL against installed locales case-insensitively in the
+// language and region, so a requested locale spelled with unexpected case
+// still matches a compiled locale name.
+func NormalizeLocaleCase(locale string) string {
+	languageAndRegion := locale
+	suffix := ""
+	if i := strings.IndexAny(locale, ".@"); i != -1 {
+		languageAndRegion = locale[:i]
+		suffix = locale[i:]
+	}
+	if i := strings.IndexByte(languageAndRegion, '_'); i != -1 {
+		language := strings.ToLower(languageAndRegion[:i])
+		region := strings.ToUpper(languageAndRegion[i+1:])
+		return language + "_" + region + suffix
+	}
+	return strings.ToLower(languageAndRegion) + suffix
+}
+
+// LocaleFallbackChain returns the locale names C++'s resolve_locale tries,
+// in order, before giving up and using the untranslated strings: locale
+// with its case normalized, then with its codeset stripped, then with its
+// @modifier stripped, then with its _REGION stripped too. A step with
+// nothing to strip repeats the previous step's string, e.g. "pt_BR" (no
+// codeset, no modifier) yields {"pt_BR", "pt_BR", "pt_BR", "pt"}.
+func LocaleFallbackChain(locale string) [4]string {
+	var chain [4]string
+	chain[0] = NormalizeLocaleCase(locale)
+	chain[1] = StripLocaleCodeset(chain[0])
+	chain[2] = StripLocaleModifier(chain[1])
+	chain[3] = StripLocaleRegion(chain[2])
+	return chain
+}
+
+// LocaleFallbackTestCase is one assertion WriteTranslationTest emits for
+// resolve_locale (C++): requesting Requested should resolve to whichever
+// compiled locale ExpectedLocale names ("" for the untranslated locale).
+type LocaleFallbackTestCase struct {
+	Requested      string
+	ExpectedLocale string
+}
+
+// flipASCIICase swaps the case of every ASCII letter in s, leaving
+// everything else (digits, punctuation) alone.
+func flipASCIICase(s string) string {
+	flipped := []byte(s)
+	for i, c := range flipped {
+		switch {
+		case c >= 'a' && c <= 'z':
+			flipped[i] = c - 'a' + 'A'
+		case c >= 'A' && c <= 'Z':
+			flipped[i] = c - 'A' + 'a'
+		}
+	}
+	return string(flipped)
+}
+
+// LocaleFallbackTestCases derives resolve_locale assertions from the locales
+// actually compiled (localeNames, in GetLocaleNames' order, including the
+// empty untranslated locale): every letter in a compiled locale's name
+// case-flipped should still resolve to it (exercising NormalizeLocaleCase),
+// and, for every compiled locale that's a bare language with no region of
+// its own, an invented "_ZZ"-region spelling of it should fall back to the
+// bare language (exercising _REGION stripping), e.g. requesting "PT_zz"
+// should resolve to "pt" if only pt.po (not pt_BR.po) is compiled.
+func LocaleFallbackTestCases(localeNames []string) []LocaleFallbackTestCase {
+	compiled := map[string]bool{}
+	for _, name := range localeNames {
+		compiled[name] = true
+	}
+
+	var cases []LocaleFallbackTestCase
+	for _, name := range localeNames {
+		if name == "" {
+			continue
+		}
+		if flipped := flipASCIICase(name); flipped != name {
+			cases = append(cases, LocaleFallbackTestCase{Requested: flipped, ExpectedLocale: name})
+		}
+		if !strings.ContainsAny(name, "_.@") {
+			fakeRegional := strings.ToUpper(name) + "_ZZ"
+			if !compiled[fakeRegional] {
+				cases = append(cases, LocaleFallbackTestCase{Requested: fakeRegional, ExpectedLocale: name})
+			}
+		}
+	}
+	return cases
+}
+
+// localeIndex returns the index of name within locales, or -1 if absent.
+func localeIndex(locales []string, name string) int {
+	for i, locale := range locales {
+		if locale == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// MessageKey identifies a distinct message: its untranslated text plus,
+// optionally, the msgctxt disambiguating it from other messages spelled the
+// same way.
+type MessageKey struct {
+	Context      []byte
+	Untranslated []byte
+}
+
+// Bytes returns the byte string used to look this message up; see
+// ContextualKey.
+func (key MessageKey) Bytes() []byte {
+	return ContextualKey(key.Context, key.Untranslated)
+}
+
+// Extracts the (Context, Untranslated) key of each TranslationEntry.
 //
-// Return value is sorted with no duplicates.
-func GetAllUntranslated(locales map[string][]TranslationEntry) [][]byte {
-	allUntranslated := [][]byte{}
-	addUntranslated := func(untranslated []byte) {
-		for _, existingUntranslated := range allUntranslated {
-			foundDuplicate := bytes.Equal(existingUntranslated, untranslated)
-			if foundDuplicate {
+// Return value is sorted by Bytes(), with no duplicates.
+func GetAllMessageKeys(locales map[string][]TranslationEntry) []MessageKey {
+	allKeys := []MessageKey{}
+	addKey := func(key MessageKey) {
+		for _, existingKey := range allKeys {
+			if bytes.Equal(existingKey.Bytes(), key.Bytes()) {
 				return
 			}
 		}
-		allUntranslated = append(allUntranslated, untranslated)
+		allKeys = append(allKeys, key)
 	}
 	for _, localeTranslations := range locales {
 		for _, translation := range localeTranslations {
 			if !translation.IsMetadata() {
-				addUntranslated(translation.Untranslated)
+				addKey(MessageKey{Context: translation.Context, Untranslated: translation.Untranslated})
 			}
 		}
 	}
 	// Sort to make output deterministic.
-	sort.Slice(allUntranslated, func(i int, j int) bool {
-		return bytes.Compare(allUntranslated[i], allUntranslated[j]) < 0
+	sort.Slice(allKeys, func(i int, j int) bool {
+		return bytes.Compare(allKeys[i].Bytes(), allKeys[j].Bytes()) < 0
 	})
-	return allUntranslated
+	return allKeys
+}
+
+// pluralExprNode is one node of a parsed gettext plural expression, e.g. the
+// "nplurals=6; plural=(n==0 ? 0 : n==1 ? 1 : ...)" expression found in a .po
+// file's Plural-Forms header. The supported grammar is exactly what gettext
+// itself supports: the variable n, integer literals, and the operators %, /,
+// ?:, &&, ||, ==, !=, <, >, <=, >=.
+type pluralExprNode struct {
+	// One of: "n", "num", "?:", or a binary operator ("%", "/", "==", "!=",
+	// "<", ">", "<=", ">=", "&&", "||").
+	Op    string
+	Value uint64 // Only used when Op == "num".
+	// Operands: 2 for a binary operator, 3 ("?:") for cond, then, else.
+	Children []*pluralExprNode
+}
+
+// Eval evaluates the expression for the given count, the way the generated
+// C++ switch does at run time.
+func (node *pluralExprNode) Eval(n uint64) uint64 {
+	boolToUint64 := func(b bool) uint64 {
+		if b {
+			return 1
+		}
+		return 0
+	}
+	switch node.Op {
+	case "n":
+		return n
+	case "num":
+		return node.Value
+	case "?:":
+		if node.Children[0].Eval(n) != 0 {
+			return node.Children[1].Eval(n)
+		}
+		return node.Children[2].Eval(n)
+	case "%":
+		return node.Children[0].Eval(n) % node.Children[1].Eval(n)
+	case "/":
+		return node.Children[0].Eval(n) / node.Children[1].Eval(n)
+	case "==":
+		return boolToUint64(node.Children[0].Eval(n) == node.Children[1].Eval(n))
+	case "!=":
+		return boolToUint64(node.Children[0].Eval(n) != node.Children[1].Eval(n))
+	case "<":
+		return boolToUint64(node.Children[0].Eval(n) < node.Children[1].Eval(n))
+	case ">":
+		return boolToUint64(node.Children[0].Eval(n) > node.Children[1].Eval(n))
+	case "<=":
+		return boolToUint64(node.Children[0].Eval(n) <= node.Children[1].Eval(n))
+	case ">=":
+		return boolToUint64(node.Children[0].Eval(n) >= node.Children[1].Eval(n))
+	case "&&":
+		return boolToUint64(node.Children[0].Eval(n) != 0 && node.Children[1].Eval(n) != 0)
+	case "||":
+		return boolToUint64(node.Children[0].Eval(n) != 0 || node.Children[1].Eval(n) != 0)
+	default:
+		panic("unrecognized plural expression operator: " + node.Op)
+	}
+}
+
+// CppSource renders the expression as a fully-parenthesized C++ expression
+// using n as the count variable, suitable for a constexpr switch case.
+func (node *pluralExprNode) CppSource() string {
+	switch node.Op {
+	case "n":
+		return "n"
+	case "num":
+		return fmt.Sprintf("%dULL", node.Value)
+	case "?:":
+		return fmt.Sprintf("(%s ? %s : %s)", node.Children[0].CppSource(), node.Children[1].CppSource(), node.Children[2].CppSource())
+	default:
+		return fmt.Sprintf("(%s %s %s)", node.Children[0].CppSource(), node.Op, node.Children[1].CppSource())
+	}
+}
+
+func mustParsePluralExpr(expr string) *pluralExprNode {
+	node, err := parsePluralExpr(expr)
+	if err != nil {
+		panic(err)
+	}
+	return node
+}
+
+// parsePluralExpr parses a gettext plural expression such as "n != 1" or
+// "n==0 ? 0 : n==1 ? 1 : 2" using recursive descent, with the same operator
+// precedence as C (from loosest to tightest): ?: , || , && , ==/!= ,
+// </>/<=/>= , %// .
+func parsePluralExpr(expr string) (*pluralExprNode, error) {
+	tokens, err := tokenizePluralExpr(expr)
+	if err != nil {
+		return nil, err
+	}
+	parser := &pluralExprParser{tokens: tokens}
+	node, err := parser.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+	if parser.pos != len(parser.tokens) {
+		return nil, fmt.Errorf("unexpected token %q in plural expression %q", parser.tokens[parser.pos], expr)
+	}
+	return node, nil
+}
+
+func tokenizePluralExpr(expr string) ([]string, error) {
+	var tokens []string
+	i := 0
+	for i < len(expr) {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i += 1
+		case c >= '0' && c <= '9':
+			start := i
+			for i < len(expr) && expr[i] >= '0' && expr[i] <= '9' {
+				i += 1
+			}
+			tokens = append(tokens, expr[start:i])
+		case c == 'n' && (i+1 == len(expr) || !isPluralIdentChar(expr[i+1])):
+			tokens = append(tokens, "n")
+			i += 1
+		case strings.HasPrefix(expr[i:], "&&"), strings.HasPrefix(expr[i:], "||"),
+			strings.HasPrefix(expr[i:], "=="), strings.HasPrefix(expr[i:], "!="),
+			strings.HasPrefix(expr[i:], "<="), strings.HasPrefix(expr[i:], ">="):
+			tokens = append(tokens, expr[i:i+2])
+			i += 2
+		case strings.ContainsRune("%/?:()<>", rune(c)):
+			tokens = append(tokens, string(c))
+			i += 1
+		default:
+			return nil, fmt.Errorf("unexpected character %q in plural expression %q", c, expr)
+		}
+	}
+	return tokens, nil
+}
+
+func isPluralIdentChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_'
+}
+
+type pluralExprParser struct {
+	tokens []string
+	pos    int
+}
+
+func (parser *pluralExprParser) peek() string {
+	if parser.pos >= len(parser.tokens) {
+		return ""
+	}
+	return parser.tokens[parser.pos]
+}
+
+func (parser *pluralExprParser) take() string {
+	token := parser.peek()
+	parser.pos += 1
+	return token
+}
+
+func (parser *pluralExprParser) parseTernary() (*pluralExprNode, error) {
+	cond, err := parser.parseBinary(binaryOperatorLevels)
+	if err != nil {
+		return nil, err
+	}
+	if parser.peek() != "?" {
+		return cond, nil
+	}
+	parser.take()
+	then, err := parser.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+	if parser.take() != ":" {
+		return nil, fmt.Errorf("expected ':' in plural expression")
+	}
+	otherwise, err := parser.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+	return &pluralExprNode{Op: "?:", Children: []*pluralExprNode{cond, then, otherwise}}, nil
+}
+
+// binaryOperatorLevels lists binary operators from loosest to tightest
+// precedence; each level is left-associative.
+var binaryOperatorLevels = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!="},
+	{"<", ">", "<=", ">="},
+	{"%", "/"},
+}
+
+func (parser *pluralExprParser) parseBinary(levels [][]string) (*pluralExprNode, error) {
+	if len(levels) == 0 {
+		return parser.parsePrimary()
+	}
+	left, err := parser.parseBinary(levels[1:])
+	if err != nil {
+		return nil, err
+	}
+	for containsString(levels[0], parser.peek()) {
+		op := parser.take()
+		right, err := parser.parseBinary(levels[1:])
+		if err != nil {
+			return nil, err
+		}
+		left = &pluralExprNode{Op: op, Children: []*pluralExprNode{left, right}}
+	}
+	return left, nil
+}
+
+func (parser *pluralExprParser) parsePrimary() (*pluralExprNode, error) {
+	token := parser.take()
+	switch {
+	case token == "n":
+		return &pluralExprNode{Op: "n"}, nil
+	case token == "(":
+		node, err := parser.parseTernary()
+		if err != nil {
+			return nil, err
+		}
+		if parser.take() != ")" {
+			return nil, fmt.Errorf("expected ')' in plural expression")
+		}
+		return node, nil
+	case len(token) > 0 && token[0] >= '0' && token[0] <= '9':
+		value, err := strconv.ParseUint(token, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid integer %q in plural expression", token)
+		}
+		return &pluralExprNode{Op: "num", Value: value}, nil
+	default:
+		return nil, fmt.Errorf("unexpected token %q in plural expression", token)
+	}
+}
+
+func containsString(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if s == needle {
+			return true
+		}
+	}
+	return false
+}
+
+// PluralForms describes how many msgstr[] forms a locale's messages can have
+// and which form applies to a given count, per that locale's PO
+// "Plural-Forms: nplurals=N; plural=EXPR;" header.
+type PluralForms struct {
+	Count      int
+	Expression *pluralExprNode
+}
+
+// EnglishPluralForms is used for the untranslated ("") locale, and for any
+// real locale whose .po file omits a Plural-Forms header.
+var EnglishPluralForms = PluralForms{
+	Count:      2,
+	Expression: mustParsePluralExpr("n != 1"),
+}
+
+var pluralFormsHeaderPattern = regexp.MustCompile(`Plural-Forms:\s*nplurals\s*=\s*(\d+)\s*;\s*plural\s*=\s*([^;\n]+)\s*;`)
+
+// GetLocalePluralForms extracts each locale's Plural-Forms header (from its
+// metadata entry, i.e. the entry with an empty msgid) and falls back to
+// EnglishPluralForms for locales that don't declare one.
+func GetLocalePluralForms(locales map[string][]TranslationEntry) (map[string]PluralForms, error) {
+	pluralForms := map[string]PluralForms{}
+	for localeName, entries := range locales {
+		pluralForms[localeName] = EnglishPluralForms
+		for _, entry := range entries {
+			if !entry.IsMetadata() || len(entry.Translated) == 0 {
+				continue
+			}
+			match := pluralFormsHeaderPattern.FindSubmatch(entry.Translated[0])
+			if match == nil {
+				continue
+			}
+			count, err := strconv.Atoi(string(match[1]))
+			if err != nil {
+				return nil, fmt.Errorf("locale %q: malformed Plural-Forms header: %w", localeName, err)
+			}
+			expression, err := parsePluralExpr(string(bytes.TrimSpace(match[2])))
+			if err != nil {
+				return nil, fmt.Errorf("locale %q: malformed Plural-Forms header: %w", localeName, err)
+			}
+			if err := checkPluralExprInRange(expression, count); err != nil {
+				return nil, fmt.Errorf("locale %q: malformed Plural-Forms header: %w", localeName, err)
+			}
+			pluralForms[localeName] = PluralForms{Count: count, Expression: expression}
+		}
+	}
+	return pluralForms, nil
+}
+
+// pluralExprCheckRange bounds how many counts checkPluralExprInRange tries
+// evaluating expression on. Real plural rules only ever branch on n itself,
+// n%10, n%100, or n%1000, so 0..1999 exercises every distinct residue class
+// gettext's plural grammar can express twice over.
+const pluralExprCheckRange = 2000
+
+// checkPluralExprInRange evaluates expression for every n in
+// [0, pluralExprCheckRange) and fails if any result falls outside
+// [0, count): the generated C++ switch uses int(expression) to index a
+// locale's Count-wide slice of msgstr[] forms, so an out-of-range result
+// would read past the end of that slice at run time.
+func checkPluralExprInRange(expression *pluralExprNode, count int) error {
+	for n := uint64(0); n < pluralExprCheckRange; n += 1 {
+		form := expression.Eval(n)
+		if form >= uint64(count) {
+			return fmt.Errorf("plural expression evaluates to %d (>= nplurals=%d) for n=%d", form, count, n)
+		}
+	}
+	return nil
 }
 
 type TranslationTable struct {
 	ConstLookupTable []TranslationTableConstLookupEntry
-	MappingTable     []TranslationTableMappingEntry
-	StringTable      []byte
-	Locales          []string
-	LocaleTable      []byte
+	// Indexed by HashFNV1a64(untranslated) % len(DisplacementTable).
+	DisplacementTable []uint64
+	MappingTable      []TranslationTableMappingEntry
+	StringTable       []byte
+	Locales           []string
+	LocaleTable       []byte
+
+	// PluralForms[i] describes Locales[i]'s plural forms. The untranslated
+	// ("") locale (always last) uses EnglishPluralForms.
+	PluralForms []PluralForms
+	// PluralSlotStart[i] is the first index, within a
+	// TranslationTableMappingEntry.StringOffsets row, holding Locales[i]'s
+	// strings. Locales[i] occupies PluralForms[i].Count consecutive slots
+	// starting there.
+	PluralSlotStart []int
+	// PluralSlotCount is the width of every StringOffsets row: the sum of
+	// every locale's PluralForms[i].Count.
+	PluralSlotCount int
+
+	// LocaleFallbackTable[i] is LocaleFallbackChain(Locales[i]), with each
+	// chain entry resolved to an index into Locales, falling back to the
+	// untranslated locale's index (len(Locales)-1) if no compiled locale
+	// has that name. See LocaleFallbackChain.
+	LocaleFallbackTable [][4]int
 }
 
 type TranslationTableConstLookupEntry struct {
+	// Untranslated is a MessageKey's Bytes(): the raw msgid, or, for a
+	// message disambiguated by msgctxt, the msgctxt and msgid joined by
+	// '\x04' (see ContextualKey).
 	Untranslated []byte
 }
 
 type TranslationTableMappingEntry struct {
-	// Key: index of locale in TranslationTable.Locales
-	// Value: offset in TranslationTable.StringTable
+	// StringOffsets is PluralSlotCount long. The slots for locale i are
+	// StringOffsets[PluralSlotStart[i] : PluralSlotStart[i]+PluralForms[i].Count],
+	// one offset (into TranslationTable.StringTable) per plural form. A
+	// message with no plural form repeats its only string in every slot, so
+	// that looking a message up never needs to special-case it.
 	StringOffsets []uint32
 }
 
-func CreateTranslationTable(locales map[string][]TranslationEntry) TranslationTable {
+func CreateTranslationTable(locales map[string][]TranslationEntry) (TranslationTable, error) {
 	table := TranslationTable{}
 
 	addStringToTable := func(stringToAdd []byte, outTable *[]byte) uint32 {
@@ -301,24 +1130,60 @@ func CreateTranslationTable(locales map[string][]TranslationEntry) TranslationTa
 		return addStringToTable(stringToAdd, &table.StringTable)
 	}
 
-	keys := GetAllUntranslated(locales)
+	messageKeys := GetAllMessageKeys(locales)
+	keys := make([][]byte, len(messageKeys))
+	for i, messageKey := range messageKeys {
+		keys[i] = messageKey.Bytes()
+	}
+	slots, displacementTable := buildMinimalPerfectHash(keys)
+	table.DisplacementTable = displacementTable
+
 	table.Locales = GetLocaleNames(locales)
 
 	// Put the untranslated ("") locale last. This has two effects:
 	// * When writing LocaleTable, we'll add an empty locale at the end,
 	//   terminating the list. This terminator is how find_locales (C++)
 	//   knows the bounds of the locale table.
-	// * Untranslated strings are placed in
-	//   hash_entry::string_offsets[locale_count].
+	// * Untranslated strings are placed in the mapping table's last slots.
 	table.Locales = append(table.Locales[1:], table.Locales[0])
 
 	for _, localeName := range table.Locales {
 		addStringToTable([]byte(localeName), &table.LocaleTable)
 	}
 
+	// Index of the untranslated "locale", the same fallback resolve_locale
+	// (C++) lands on when no compiled locale matches.
+	untranslatedLocaleIndex := len(table.Locales) - 1
+	table.LocaleFallbackTable = make([][4]int, len(table.Locales))
+	for i, localeName := range table.Locales {
+		chain := LocaleFallbackChain(localeName)
+		for step, candidate := range chain {
+			if index := localeIndex(table.Locales, candidate); index != -1 {
+				table.LocaleFallbackTable[i][step] = index
+			} else {
+				table.LocaleFallbackTable[i][step] = untranslatedLocaleIndex
+			}
+		}
+	}
+
+	localePluralForms, err := GetLocalePluralForms(locales)
+	if err != nil {
+		return TranslationTable{}, err
+	}
+	localePluralForms[""] = EnglishPluralForms
+	table.PluralForms = make([]PluralForms, len(table.Locales))
+	table.PluralSlotStart = make([]int, len(table.Locales))
+	slot := 0
+	for i, localeName := range table.Locales {
+		table.PluralForms[i] = localePluralForms[localeName]
+		table.PluralSlotStart[i] = slot
+		slot += table.PluralForms[i].Count
+	}
+	table.PluralSlotCount = slot
+
 	table.ConstLookupTable = make([]TranslationTableConstLookupEntry, len(keys))
 	for i, key := range keys {
-		table.ConstLookupTable[i].Untranslated = key
+		table.ConstLookupTable[slots[i]].Untranslated = key
 	}
 
 	table.StringTable = []byte{0}
@@ -326,19 +1191,36 @@ func CreateTranslationTable(locales map[string][]TranslationEntry) TranslationTa
 	table.MappingTable = make([]TranslationTableMappingEntry, mappingTableSize)
 	for i := 0; i < mappingTableSize; i += 1 {
 		mappingEntry := &table.MappingTable[i]
-		mappingEntry.StringOffsets = make([]uint32, len(table.Locales))
+		mappingEntry.StringOffsets = make([]uint32, table.PluralSlotCount)
 	}
 	for localeIndex, localeName := range table.Locales {
+		slotStart := table.PluralSlotStart[localeIndex]
+		slotCount := table.PluralForms[localeIndex].Count
 		localeTranslations := locales[localeName]
 		for _, translation := range localeTranslations {
-			if !translation.IsMetadata() {
-				index := table.FindMappingTableIndexForUntranslated(translation.Untranslated)
-				table.MappingTable[index].StringOffsets[localeIndex] = addString(translation.Translated)
+			if translation.IsMetadata() {
+				continue
+			}
+			index := table.FindMappingTableIndexForUntranslated(ContextualKey(translation.Context, translation.Untranslated))
+			offsets := table.MappingTable[index].StringOffsets
+			for form := 0; form < slotCount; form += 1 {
+				// A message with fewer msgstr[] forms than the locale
+				// declares (i.e. it has no msgid_plural) repeats its last
+				// available form.
+				translated := translation.Translated[minInt(form, len(translation.Translated)-1)]
+				offsets[slotStart+form] = addString(translated)
 			}
 		}
 	}
 
-	return table
+	return table, nil
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
 }
 
 // Returns an index into table.MappingTable.
@@ -387,6 +1269,7 @@ func WriteTranslationTableHeader(table *TranslationTable, path string) error {
 #include <quick-lint-js/assert.h>
 #include <quick-lint-js/consteval.h>
 #include <quick-lint-js/translation-table.h>
+#include <string>
 #include <string_view>
 
 namespace quick_lint_js {
@@ -397,28 +1280,120 @@ using namespace std::literals::string_view_literals;
 	fmt.Fprintf(writer, "constexpr std::uint16_t translation_table_mapping_table_size = %d;\n", len(table.MappingTable))
 	fmt.Fprintf(writer, "constexpr std::size_t translation_table_string_table_size = %d;\n", len(table.StringTable))
 	fmt.Fprintf(writer, "constexpr std::size_t translation_table_locale_table_size = %d;\n", len(table.LocaleTable))
+	fmt.Fprintf(writer, "constexpr std::size_t translation_table_plural_slot_count = %d;\n", table.PluralSlotCount)
 	fmt.Fprintf(writer, "\n")
 
+	writer.WriteString("// Indexed by locale index (translation_table_locale_count is the untranslated locale).\n")
+	writer.WriteString("constexpr std::uint16_t translation_table_plural_slot_starts[] = {\n")
+	for _, start := range table.PluralSlotStart {
+		fmt.Fprintf(writer, "    %d,\n", start)
+	}
+	writer.WriteString("};\n")
+	writer.WriteString("constexpr std::uint16_t translation_table_plural_counts[] = {\n")
+	for _, pluralForms := range table.PluralForms {
+		fmt.Fprintf(writer, "    %d,\n", pluralForms.Count)
+	}
+	writer.WriteString("};\n\n")
+
+	writer.WriteString("// locale_fallback_table[i] holds the locale indexes resolve_locale tries,\n")
+	writer.WriteString("// in order, when asked to resolve the i'th locale in locale_table: itself\n")
+	writer.WriteString("// with its case normalized, then with its codeset stripped, then with its\n")
+	writer.WriteString("// @modifier stripped, then with its _REGION stripped too. A step whose\n")
+	writer.WriteString("// stripped name matches no compiled locale falls back to\n")
+	writer.WriteString("// translation_table_locale_count, the untranslated \"locale\", same as\n")
+	writer.WriteString("// resolve_locale itself does.\n")
+	writer.WriteString("// clang-format off\n")
+	writer.WriteString("constexpr std::uint16_t locale_fallback_table[][4] = {\n")
+	for _, chain := range table.LocaleFallbackTable {
+		writer.WriteString("    {")
+		for _, index := range chain {
+			fmt.Fprintf(writer, "%d, ", index)
+		}
+		writer.WriteString("},\n")
+	}
+	writer.WriteString("};\n")
+	writer.WriteString("// clang-format on\n\n")
+
+	writer.WriteString("// Returns which of a locale's translation_table_plural_counts[locale_index]\n")
+	writer.WriteString("// slots holds the message applicable to n.\n")
+	writer.WriteString("constexpr int translation_table_plural_form_index(std::uint32_t locale_index, unsigned long long n) {\n")
+	writer.WriteString("  switch (locale_index) {\n")
+	for i, pluralForms := range table.PluralForms {
+		fmt.Fprintf(writer, "    case %d: return int(%s);\n", i, pluralForms.Expression.CppSource())
+	}
+	writer.WriteString("    default: QLJS_CONSTEXPR_ASSERT(false); return 0;\n")
+	writer.WriteString("  }\n")
+	writer.WriteString("}\n\n")
+
 	writer.WriteString(
-		`QLJS_CONSTEVAL std::uint16_t translation_table_const_look_up(
+		`QLJS_CONSTEVAL std::uint64_t translation_table_hash_fnv_1a_64(
+    std::string_view data, std::uint64_t offset_basis) {
+  std::uint64_t hash = offset_basis;
+  for (unsigned char c : data) {
+    hash ^= std::uint64_t(c);
+    hash *= 0x00000100'000001b3ULL;
+  }
+  return hash;
+}
+
+// Turns a CHD displacement counter into a well-diffused 64-bit value. See
+// mixDisplacement in tools/compile-translations.go for why folding
+// displacement into an FNV-1a offset basis (rather than hashing its bytes)
+// isn't good enough.
+QLJS_CONSTEVAL std::uint64_t translation_table_mix_displacement(
+    std::uint64_t displacement) {
+  char displacement_bytes[8];
+  for (int i = 0; i < 8; ++i) {
+    displacement_bytes[i] = static_cast<char>(displacement >> (8 * i));
+  }
+  return translation_table_hash_fnv_1a_64(
+      std::string_view(displacement_bytes, 8), 0xcbf29ce484222325ULL);
+}
+
+// SplitMix64's finalizer (Steele, Lea & Flood, 2014). See avalanche64 in
+// tools/compile-translations.go: every output bit depends on every input
+// bit, unlike FNV-1a's per-byte update.
+QLJS_CONSTEVAL std::uint64_t translation_table_avalanche(std::uint64_t x) {
+  x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9ULL;
+  x = (x ^ (x >> 27)) * 0x94d049bb133111ebULL;
+  x = x ^ (x >> 31);
+  return x;
+}
+
+QLJS_CONSTEVAL std::uint16_t translation_table_const_look_up(
     std::string_view untranslated) {
   // clang-format off
-  constexpr std::string_view const_lookup_table[] = {
+  constexpr std::string_view keys[] = {
 `)
 	for _, constLookupEntry := range table.ConstLookupTable {
 		fmt.Fprintf(writer, "          \"")
 		DumpStringLiteralBody(string(constLookupEntry.Untranslated), writer)
 		writer.WriteString("\"sv,\n")
 	}
+	writer.WriteString(
+		`  };
+  constexpr std::uint64_t displacement_table[] = {
+`)
+	for _, displacement := range table.DisplacementTable {
+		fmt.Fprintf(writer, "          0x%xULL,\n", displacement)
+	}
 	fmt.Fprintf(writer,
 		`  };
   // clang-format on
 
-  std::uint16_t table_size = std::uint16_t(std::size(const_lookup_table));
-  for (std::uint16_t i = 0; i < table_size; ++i) {
-    if (const_lookup_table[i] == untranslated) {
-      return std::uint16_t(i + 1);
-    }
+  constexpr std::uint64_t default_offset_basis = 0x%016xULL;
+  std::uint64_t key_count = std::uint64_t(std::size(keys));
+  std::uint64_t bucket_count = std::uint64_t(std::size(displacement_table));
+
+  std::uint64_t hash_1 = translation_table_hash_fnv_1a_64(untranslated, default_offset_basis);
+  std::uint64_t displacement = displacement_table[hash_1 %% bucket_count];
+  std::uint64_t hash_2 = translation_table_avalanche(hash_1 ^ translation_table_mix_displacement(displacement));
+  std::uint64_t slot = hash_2 %% key_count;
+
+  if (keys[slot] == untranslated) {`, defaultFNV1aOffsetBasis)
+	fmt.Fprintf(writer,
+		`
+    return std::uint16_t(slot + 1);
   }
 
   // If you see an error with the following line, translation-table-generated.h
@@ -427,6 +1402,91 @@ using namespace std::literals::string_view_literals;
 
   return 0;
 }
+
+// Like translation_table_const_look_up, but for a message disambiguated by
+// msgctxt (see QLJS_TRANSLATABLE_CTX). context and untranslated are joined
+// with '\x04', matching the on-disk key produced by compile-translations.go.
+QLJS_CONSTEVAL std::uint16_t translation_table_const_look_up_ctx(
+    std::string_view context, std::string_view untranslated) {
+  std::string key;
+  key.reserve(context.size() + 1 + untranslated.size());
+  key += context;
+  key += '\x04';
+  key += untranslated;
+  return translation_table_const_look_up(std::string_view(key));
+}
+
+namespace {
+// Returns the index of name within translation_data.locale_table, or
+// translation_table_locale_count (the untranslated "locale") if no
+// compiled locale has that name.
+inline std::uint32_t translation_table_find_locale(std::string_view name) {
+  const char *p = translation_data.locale_table;
+  for (std::uint32_t i = 0; i < translation_table_locale_count; ++i) {
+    std::string_view locale(p);
+    if (locale == name) {
+      return i;
+    }
+    p += locale.size() + 1;
+  }
+  return translation_table_locale_count;
+}
+
+// Mirrors compile-translations.go's NormalizeLocaleCase: lowercases the
+// language component and uppercases the _REGION component of a locale name,
+// leaving any .codeset or @modifier suffix untouched, so a requested locale
+// spelled with unexpected case (e.g. "PT_br") still matches a compiled
+// "pt_BR".
+inline std::string translation_table_normalize_locale_case(
+    std::string_view locale) {
+  std::string_view language_and_region =
+      locale.substr(0, locale.find_first_of(".@"));
+  std::string_view suffix = locale.substr(language_and_region.size());
+  std::string normalized;
+  normalized.reserve(locale.size());
+  std::size_t underscore = language_and_region.find('_');
+  std::string_view language = language_and_region.substr(0, underscore);
+  for (char c : language) {
+    normalized += (c >= 'A' && c <= 'Z') ? char(c - 'A' + 'a') : c;
+  }
+  if (underscore != std::string_view::npos) {
+    normalized += '_';
+    std::string_view region = language_and_region.substr(underscore + 1);
+    for (char c : region) {
+      normalized += (c >= 'a' && c <= 'z') ? char(c - 'a' + 'A') : c;
+    }
+  }
+  normalized += suffix;
+  return normalized;
+}
+}
+
+// Finds the compiled locale closest to requested, mirroring
+// compile-translations.go's LocaleFallbackChain (and locale_fallback_table,
+// its precomputed counterpart for the locales we already compiled in):
+// requested with its case normalized, then with its codeset stripped, then
+// with its @modifier stripped, then with its _REGION stripped too. Returns
+// translation_table_locale_count (the untranslated "locale") if none of
+// those match a compiled locale.
+inline std::uint32_t resolve_locale(std::string_view requested) {
+  std::string normalized = translation_table_normalize_locale_case(requested);
+  std::string_view normalized_view = normalized;
+  std::string_view codeset_stripped =
+      normalized_view.substr(0, normalized_view.find('.'));
+  std::string_view modifier_stripped =
+      codeset_stripped.substr(0, codeset_stripped.find('@'));
+  std::string_view region_stripped =
+      modifier_stripped.substr(0, modifier_stripped.find('_'));
+  std::string_view candidates[] = {normalized_view, codeset_stripped,
+                                    modifier_stripped, region_stripped};
+  for (std::string_view candidate : candidates) {
+    std::uint32_t index = translation_table_find_locale(candidate);
+    if (index != translation_table_locale_count) {
+      return index;
+    }
+  }
+  return translation_table_locale_count;
+}
 }
 
 #endif
@@ -510,16 +1570,46 @@ func WriteTranslationTest(locales map[string][]TranslationEntry, path string) er
 	writer := bufio.NewWriter(outputFile)
 
 	localeNames := GetLocaleNames(locales)
-	allUntranslated := GetAllUntranslated(locales)
+	messageKeys := GetAllMessageKeys(locales)
+
+	localePluralForms, err := GetLocalePluralForms(locales)
+	if err != nil {
+		return err
+	}
+	localePluralForms[""] = EnglishPluralForms
+	pluralSlotStart := make([]int, len(localeNames))
+	slot := 0
+	for i, localeName := range localeNames {
+		pluralSlotStart[i] = slot
+		slot += localePluralForms[localeName].Count
+	}
+	pluralSlotCount := slot
+
+	// Every message sharing a key also shares its msgid_plural (or lack
+	// thereof), so any locale that translates a plural message tells us the
+	// plural id for every locale.
+	pluralIDByKey := map[string][]byte{}
+	for _, entries := range locales {
+		for _, entry := range entries {
+			if !entry.IsMetadata() && entry.HasPlural() {
+				pluralIDByKey[string(ContextualKey(entry.Context, entry.Untranslated))] = entry.UntranslatedPlural
+			}
+		}
+	}
 
-	// Returns the untranslated string if there is no translation.
-	lookUpTranslation := func(localeName string, untranslated []byte) []byte {
+	// Returns one string per plural form declared by localeName's
+	// Plural-Forms header, falling back to the untranslated string (repeated
+	// across forms) where no translation exists.
+	lookUpTranslationForms := func(localeName string, key MessageKey) [][]byte {
 		for _, entry := range locales[localeName] {
-			if bytes.Equal(entry.Untranslated, untranslated) {
+			if bytes.Equal(entry.Context, key.Context) && bytes.Equal(entry.Untranslated, key.Untranslated) {
 				return entry.Translated
 			}
 		}
-		return untranslated
+		if pluralID := pluralIDByKey[string(key.Bytes())]; len(pluralID) != 0 {
+			return [][]byte{key.Untranslated, pluralID}
+		}
+		return [][]byte{key.Untranslated}
 	}
 
 	writeFileHeader(writer)
@@ -547,6 +1637,45 @@ inline constexpr const char *test_locale_names[] = {
 		`};
 // clang-format on
 
+// test_locale_names[i] owns the slots
+// [test_plural_slot_starts[i], test_plural_slot_starts[i] + test_plural_counts[i])
+// of translated_string::expected_per_locale, one slot per plural form
+// test_locale_names[i]'s Plural-Forms header declares.
+inline constexpr int test_plural_slot_starts[] = {
+`)
+	for _, start := range pluralSlotStart {
+		fmt.Fprintf(writer, "    %d,\n", start)
+	}
+	fmt.Fprintf(writer, "};\ninline constexpr int test_plural_counts[] = {\n")
+	for _, localeName := range localeNames {
+		fmt.Fprintf(writer, "    %d,\n", localePluralForms[localeName].Count)
+	}
+	writer.WriteString("};\n\n")
+
+	writer.WriteString(
+		`// A case- or specificity-mangled spelling of a compiled locale that
+// resolve_locale should still map back to it: expected_locale names one of
+// test_locale_names, or "" if requested should fall back to the
+// untranslated locale.
+struct locale_fallback_test_case {
+  const char *requested;
+  const char *expected_locale;
+};
+
+// clang-format off
+inline constexpr locale_fallback_test_case test_locale_fallback_cases[] = {
+`)
+	for _, testCase := range LocaleFallbackTestCases(localeNames) {
+		fmt.Fprintf(writer, "    {\"")
+		DumpStringLiteralBody(testCase.Requested, writer)
+		fmt.Fprintf(writer, "\", \"")
+		DumpStringLiteralBody(testCase.ExpectedLocale, writer)
+		fmt.Fprintf(writer, "\"},\n")
+	}
+	fmt.Fprintf(writer,
+		`};
+// clang-format on
+
 struct translated_string {
   translatable_message translatable;
   const char8 *expected_per_locale[%d];
@@ -554,15 +1683,33 @@ struct translated_string {
 
 // clang-format off
 inline constexpr translated_string test_translation_table[] = {
-`, len(localeNames))
-
-	for _, untranslated := range allUntranslated {
-		fmt.Fprintf(writer, "    {\n        \"")
-		DumpStringLiteralBody(string(untranslated), writer)
-		fmt.Fprintf(writer, "\"_translatable,\n        {\n")
-		for _, localeName := range localeNames {
+`, pluralSlotCount)
+
+	for _, key := range messageKeys {
+		fmt.Fprintf(writer, "    {\n        ")
+		if len(key.Context) == 0 {
+			fmt.Fprintf(writer, "\"")
+			DumpStringLiteralBody(string(key.Untranslated), writer)
+			fmt.Fprintf(writer, "\"_translatable,\n        {\n")
+		} else {
+			fmt.Fprintf(writer, "QLJS_TRANSLATABLE_CTX(\"")
+			DumpStringLiteralBody(string(key.Context), writer)
+			fmt.Fprintf(writer, "\", \"")
+			DumpStringLiteralBody(string(key.Untranslated), writer)
+			fmt.Fprintf(writer, "\"),\n        {\n")
+		}
+		expectedBySlot := make([][]byte, pluralSlotCount)
+		for i, localeName := range localeNames {
+			forms := lookUpTranslationForms(localeName, key)
+			count := localePluralForms[localeName].Count
+			start := pluralSlotStart[i]
+			for form := 0; form < count; form += 1 {
+				expectedBySlot[start+form] = forms[minInt(form, len(forms)-1)]
+			}
+		}
+		for _, expected := range expectedBySlot {
 			fmt.Fprintf(writer, "            u8\"")
-			DumpStringLiteralBody(string(lookUpTranslation(localeName, untranslated)), writer)
+			DumpStringLiteralBody(string(expected), writer)
 			fmt.Fprintf(writer, "\",\n")
 		}
 		fmt.Fprintf(writer, "        },\n    },\n")
@@ -641,8 +1788,46 @@ func DumpStringLiteralBody(s string, writer *bufio.Writer) {
 	}
 }
 
+const defaultFNV1aOffsetBasis uint64 = 0xcbf29ce484222325
+
 func HashFNV1a64(data []byte) uint64 {
-	return HashFNV1a64WithOffsetBasis(data, 0xcbf29ce484222325)
+	return HashFNV1a64WithOffsetBasis(data, defaultFNV1aOffsetBasis)
+}
+
+// mixDisplacement turns a small CHD displacement counter into a
+// well-diffused 64-bit value. Folding displacement into the offset basis of
+// a second FNV-1a pass (offsetBasis + displacement, or even hashing
+// displacement's bytes into a fresh basis) still runs the key through the
+// same weak per-byte multiply-xor update as the first hash, so two keys that
+// happen to share a long prefix or suffix keep landing in a fixed, narrow
+// relationship to each other no matter which displacement is tried. Instead,
+// this hashes displacement's byte representation and folds it in with
+// avalanche64 (see bucketSlotHash), so the second hash's diffusion doesn't
+// depend on FNV-1a's per-byte avalanche at all.
+func mixDisplacement(displacement uint64) uint64 {
+	var displacementBytes [8]byte
+	binary.LittleEndian.PutUint64(displacementBytes[:], displacement)
+	return HashFNV1a64(displacementBytes[:])
+}
+
+// avalanche64 is SplitMix64's finalizer (Steele, Lea & Flood, "Fast
+// Splittable Pseudorandom Number Generators", 2014). Every output bit
+// depends on every input bit, which is exactly what FNV-1a's per-byte
+// multiply-xor update lacks: two inputs differing in only a couple of bits
+// (as two FNV-1a hashes of similar keys do) come out looking unrelated.
+func avalanche64(x uint64) uint64 {
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	x = x ^ (x >> 31)
+	return x
+}
+
+// bucketSlotHash computes the slot a key with FNV-1a hash keyHash lands on
+// for a given CHD displacement, out of slotCount slots. It's shared by
+// buildMinimalPerfectHash and translation_table_const_look_up (C++) so both
+// derive the same slot for the same (key, displacement) pair.
+func bucketSlotHash(keyHash uint64, displacement uint64, slotCount uint64) uint64 {
+	return avalanche64(keyHash^mixDisplacement(displacement)) % slotCount
 }
 
 func HashFNV1a64WithOffsetBasis(data []byte, offsetBasis uint64) uint64 {
@@ -654,6 +1839,90 @@ func HashFNV1a64WithOffsetBasis(data []byte, offsetBasis uint64) uint64 {
 	return hash
 }
 
+// maxDisplacementAttempts bounds the per-bucket displacement search in
+// buildMinimalPerfectHash. With bucketSlotHash's full-range diffusion, a
+// bucket that hasn't found a free displacement after this many tries almost
+// certainly never will (its keys collide under every displacement, not just
+// an unlucky run of them), so we fail loudly instead of spinning forever.
+const maxDisplacementAttempts = 1 << 20
+
+// buildMinimalPerfectHash computes a CHD-style minimum perfect hash over
+// keys. It returns, for each entry of keys, the slot that entry occupies in
+// a len(keys)-sized array, and a displacement table indexed by
+// HashFNV1a64(key) % len(displacementTable). translation_table_const_look_up
+// (C++) re-derives the same slot at compile time by looking up that
+// displacement and calling bucketSlotHash with the key's own FNV-1a hash.
+func buildMinimalPerfectHash(keys [][]byte) (slots []int, displacementTable []uint64) {
+	n := len(keys)
+	if n == 0 {
+		return nil, nil
+	}
+
+	// Aim for a handful of keys per bucket; smaller buckets are cheaper to
+	// place but need more buckets (and thus a bigger displacement table).
+	bucketCount := n/4 + 1
+	buckets := make([][]int, bucketCount)
+	for keyIndex, key := range keys {
+		bucket := int(HashFNV1a64(key) % uint64(bucketCount))
+		buckets[bucket] = append(buckets[bucket], keyIndex)
+	}
+
+	// Place the most crowded buckets first: they're the least likely to find
+	// a displacement that avoids every other bucket's already-claimed slots.
+	bucketsByDescendingSize := make([]int, bucketCount)
+	for i := range bucketsByDescendingSize {
+		bucketsByDescendingSize[i] = i
+	}
+	sort.SliceStable(bucketsByDescendingSize, func(i int, j int) bool {
+		return len(buckets[bucketsByDescendingSize[i]]) > len(buckets[bucketsByDescendingSize[j]])
+	})
+
+	slots = make([]int, n)
+	slotIsUsed := make([]bool, n)
+	displacementTable = make([]uint64, bucketCount)
+	candidateSlots := make([]int, 0, n)
+
+	for _, bucket := range bucketsByDescendingSize {
+		bucketKeyIndexes := buckets[bucket]
+		if len(bucketKeyIndexes) == 0 {
+			continue
+		}
+		bucketKeyHashes := make([]uint64, len(bucketKeyIndexes))
+		for i, keyIndex := range bucketKeyIndexes {
+			bucketKeyHashes[i] = HashFNV1a64(keys[keyIndex])
+		}
+		placed := false
+	displacementSearch:
+		for displacement := uint64(0); displacement < maxDisplacementAttempts; displacement += 1 {
+			candidateSlots = candidateSlots[:0]
+			for _, keyHash := range bucketKeyHashes {
+				slot := int(bucketSlotHash(keyHash, displacement, uint64(n)))
+				if slotIsUsed[slot] {
+					continue displacementSearch
+				}
+				for _, claimedSlot := range candidateSlots {
+					if claimedSlot == slot {
+						continue displacementSearch
+					}
+				}
+				candidateSlots = append(candidateSlots, slot)
+			}
+			for i, keyIndex := range bucketKeyIndexes {
+				slots[keyIndex] = candidateSlots[i]
+				slotIsUsed[candidateSlots[i]] = true
+			}
+			displacementTable[bucket] = displacement
+			placed = true
+			break
+		}
+		if !placed {
+			log.Fatalf("compile-translations: could not place bucket of %d key(s) after %d displacement attempts; the key set likely contains near-duplicate keys that collide under every displacement", len(bucketKeyIndexes), maxDisplacementAttempts)
+		}
+	}
+
+	return slots, displacementTable
+}
+
 // quick-lint-js finds bugs in JavaScript programs.
 // Copyright (C) 2020  Matthew "strager" Glazar
 //